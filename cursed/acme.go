@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// acmeChallengeType is curse's RFC 8555 extension: instead of proving control of a
+// domain via DNS-01/HTTP-01, the client proves it is the already bastion-authenticated
+// user named in the account contact, by presenting conf.UserHeader the same way /auth/
+// does.
+const acmeChallengeType = "curse-header-01"
+
+// acmeAuthorizedBroker reports whether r arrived over the bastion-authenticated broker
+// connection, the same check tlsCertHandler/revokeCertHandler make before trusting any
+// header or body content. Every /acme/* handler must pass this check too, since the
+// ACME surface grants the same certificate-issuance power as /auth/.
+func acmeAuthorizedBroker(w http.ResponseWriter, r *http.Request, conf *config) bool {
+	if len(r.TLS.PeerCertificates) == 0 {
+		log.Printf("Invalid connection")
+		http.Error(w, "Invalid connection", http.StatusBadRequest)
+		return false
+	}
+	fp := tlsCertFP(r.TLS.PeerCertificates[0])
+	if bytes.Compare(conf.brokerFP, fp) != 0 {
+		log.Printf("Not authorized to use acme endpoint: ip[%s] user[%s] cert[%s]", r.RemoteAddr, r.TLS.PeerCertificates[0].Subject.CommonName, fp)
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+type acmeAccount struct {
+	ID        string    `json:"id"`
+	Contact   []string  `json:"contact"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	JWK       *acmeJWK  `json:"jwk,omitempty"`
+}
+
+type acmeOrder struct {
+	ID          string           `json:"id"`
+	AccountID   string           `json:"account_id"`
+	Status      string           `json:"status"`
+	Identifiers []acmeIdentifier `json:"identifiers"`
+	AuthzIDs    []string         `json:"authz_ids"`
+	CSR         string           `json:"csr,omitempty"`
+	CertSerial  string           `json:"cert_serial,omitempty"`
+	CertPEM     string           `json:"cert_pem,omitempty"`
+}
+
+// acmeOrderView is the RFC 8555 §7.1.3 order object curse hands back to clients: the
+// storage-only acmeOrder plus the full authorizations/finalize/certificate URLs a
+// standard client (certbot, lego, step) reads to drive the order forward, rather than
+// synthesizing them itself.
+type acmeOrderView struct {
+	ID             string           `json:"id"`
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate,omitempty"`
+}
+
+// view renders o the way RFC 8555 clients expect it, resolving authz/finalize/
+// certificate URLs against the base URL this request arrived on.
+func (o acmeOrder) view(conf *config, r *http.Request) acmeOrderView {
+	base := acmeBaseURL(conf, r)
+	v := acmeOrderView{
+		ID:          o.ID,
+		Status:      o.Status,
+		Identifiers: o.Identifiers,
+		Finalize:    base + "/acme/order/" + o.ID + "/finalize",
+	}
+	for _, authzID := range o.AuthzIDs {
+		v.Authorizations = append(v.Authorizations, base+"/acme/authz/"+authzID)
+	}
+	if o.Status == "valid" && o.CertPEM != "" {
+		v.Certificate = base + "/acme/certificate/" + o.ID
+	}
+	return v
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeAuthz struct {
+	ID         string          `json:"id"`
+	AccountID  string          `json:"account_id"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Status     string          `json:"status"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string `json:"type"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+	URL    string `json:"url"`
+}
+
+// acmeDirectoryHandler serves the RFC 8555 directory object every ACME client fetches
+// first to discover the daemon's other endpoint URLs.
+func acmeDirectoryHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+	base := acmeBaseURL(conf, r)
+	dir := map[string]interface{}{
+		"newNonce":   base + "/acme/new-nonce",
+		"newAccount": base + "/acme/new-account",
+		"newOrder":   base + "/acme/new-order",
+		"meta": map[string]interface{}{
+			"caaIdentities": []string{conf.SSLCertHostname},
+		},
+	}
+	writeJSON(w, http.StatusOK, dir)
+}
+
+// acmeNewNonceHandler hands back a fresh anti-replay nonce in the Replay-Nonce header,
+// as RFC 8555 section 7.2 requires before newAccount/newOrder/etc. can be used.
+func acmeNewNonceHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+	nonce, err := newACMENonce(conf)
+	if err != nil {
+		log.Printf("Failed to mint acme nonce: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Replay-Nonce", nonce)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// acmeNewAccountHandler registers an account under a fresh random ID, recording the
+// contacts the client supplied; the challenge (curse-header-01) and finalize handlers
+// require conf.UserHeader on their request to match one of those contacts.
+func acmeNewAccountHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+
+	var req struct {
+		Contact []string `json:"contact"`
+	}
+	var acct acmeAccount
+	if err := decodeACMEJWS(r, conf, &req, &acct); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid account payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Contact) == 0 {
+		http.Error(w, "account requires at least one contact", http.StatusBadRequest)
+		return
+	}
+
+	acct.ID = newACMEID("acct")
+	acct.Contact = req.Contact
+	acct.Status = "valid"
+	acct.CreatedAt = time.Now()
+	if err := dbPutACME(conf, conf.bucketNameACMEAccounts, acct.ID, acct); err != nil {
+		log.Printf("Failed to persist acme account: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", acmeBaseURL(conf, r)+"/acme/account/"+acct.ID)
+	writeJSON(w, http.StatusCreated, acct)
+}
+
+// acmeNewOrderHandler creates an order plus one pending authz/challenge per requested
+// identifier.
+func acmeNewOrderHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+
+	var req struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	var acct acmeAccount
+	if err := decodeACMEJWS(r, conf, &req, &acct); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid order payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if acct.ID == "" {
+		http.Error(w, "Unknown account", http.StatusBadRequest)
+		return
+	}
+	if len(req.Identifiers) == 0 {
+		http.Error(w, "order requires at least one identifier", http.StatusBadRequest)
+		return
+	}
+
+	order := acmeOrder{
+		ID:          newACMEID("order"),
+		AccountID:   acct.ID,
+		Status:      "pending",
+		Identifiers: req.Identifiers,
+	}
+
+	for _, ident := range req.Identifiers {
+		authz := acmeAuthz{
+			ID:         newACMEID("authz"),
+			AccountID:  acct.ID,
+			Identifier: ident,
+			Status:     "pending",
+			Challenges: []acmeChallenge{{
+				Type:   acmeChallengeType,
+				Token:  newACMEID("token"),
+				Status: "pending",
+			}},
+		}
+		authz.Challenges[0].URL = acmeBaseURL(conf, r) + "/acme/challenge/" + authz.ID
+		if err := dbPutACME(conf, conf.bucketNameACMEAuthzs, authz.ID, authz); err != nil {
+			log.Printf("Failed to persist acme authz: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		order.AuthzIDs = append(order.AuthzIDs, authz.ID)
+	}
+
+	if err := dbPutACME(conf, conf.bucketNameACMEOrders, order.ID, order); err != nil {
+		log.Printf("Failed to persist acme order: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", acmeBaseURL(conf, r)+"/acme/order/"+order.ID)
+	writeJSON(w, http.StatusCreated, order.view(conf, r))
+}
+
+// acmeAuthzHandler returns the current state of an authorization and its challenges.
+func acmeAuthzHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+	authzID := strings.TrimPrefix(r.URL.Path, "/acme/authz/")
+	var authz acmeAuthz
+	if found, err := dbGetACME(conf, conf.bucketNameACMEAuthzs, authzID, &authz); err != nil || !found {
+		http.Error(w, "Unknown authorization", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, authz)
+}
+
+// acmeChallengeHandler validates the curse-header-01 challenge: the bastion user named
+// in conf.UserHeader on this request must match one of the account's contacts. This
+// reuses curse's existing bastion-trust model instead of DNS-01/HTTP-01.
+func acmeChallengeHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+	authzID := strings.TrimPrefix(r.URL.Path, "/acme/challenge/")
+	var authz acmeAuthz
+	if found, err := dbGetACME(conf, conf.bucketNameACMEAuthzs, authzID, &authz); err != nil || !found {
+		http.Error(w, "Unknown authorization", http.StatusNotFound)
+		return
+	}
+
+	var acct acmeAccount
+	var req struct{}
+	if err := decodeACMEJWS(r, conf, &req, &acct); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid challenge response: %v", err), http.StatusBadRequest)
+		return
+	}
+	if acct.ID != authz.AccountID {
+		http.Error(w, "Account does not own this authorization", http.StatusForbidden)
+		return
+	}
+
+	bastionUser := r.Header.Get(conf.UserHeader)
+	if bastionUser == "" || !contains(acct.Contact, bastionUser) {
+		http.Error(w, fmt.Sprintf("%s does not match account contact", conf.UserHeader), http.StatusForbidden)
+		return
+	}
+
+	authz.Status = "valid"
+	authz.Challenges[0].Status = "valid"
+	if err := dbPutACME(conf, conf.bucketNameACMEAuthzs, authz.ID, authz); err != nil {
+		log.Printf("Failed to persist acme authz: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, authz.Challenges[0])
+}
+
+// acmeFinalizeHandler accepts the order's CSR once every authz is valid, and funnels it
+// into signTLSClientCert for the actual issuance, same as a normal /auth/ request.
+func acmeFinalizeHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+
+	orderID := strings.TrimPrefix(r.URL.Path, "/acme/order/")
+	orderID = strings.TrimSuffix(orderID, "/finalize")
+
+	var order acmeOrder
+	if found, err := dbGetACME(conf, conf.bucketNameACMEOrders, orderID, &order); err != nil || !found {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+
+	for _, authzID := range order.AuthzIDs {
+		var authz acmeAuthz
+		if found, err := dbGetACME(conf, conf.bucketNameACMEAuthzs, authzID, &authz); err != nil || !found || authz.Status != "valid" {
+			http.Error(w, "Order has unauthorized identifiers", http.StatusForbidden)
+			return
+		}
+	}
+
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	var acct acmeAccount
+	if err := decodeACMEJWS(r, conf, &req, &acct); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid finalize payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if acct.ID != order.AccountID {
+		http.Error(w, "Account does not own this order", http.StatusForbidden)
+		return
+	}
+
+	csrDER, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		http.Error(w, "csr is not valid base64url", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse csr: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := csr.CheckSignature(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to check csr signature: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Bind the CSR to the bastion-authenticated identity that completed the
+	// curse-header-01 challenge for this order, the same way tlsCertHandler binds a
+	// CSR to conf.UserHeader - otherwise a validated authz for one identity would let
+	// the client request a cert for any CommonName it likes.
+	bastionUser := r.Header.Get(conf.UserHeader)
+	if bastionUser == "" || !contains(acct.Contact, bastionUser) {
+		http.Error(w, fmt.Sprintf("%s does not match account contact", conf.UserHeader), http.StatusForbidden)
+		return
+	}
+	if csr.Subject.CommonName != bastionUser {
+		http.Error(w, "CSR CommonName field does not match logged-in user, denying request", http.StatusBadRequest)
+		return
+	}
+
+	groups := splitGroups(r.Header.Get(conf.GroupsHeader))
+	prof, err := selectProfile(conf, "default", bastionUser, groups, "")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("profile selection failed: %v", err), http.StatusForbidden)
+		return
+	}
+	if err := prof.validateTLSKeyUsage(csr); err != nil {
+		http.Error(w, fmt.Sprintf("profile validation failed: %v", err), http.StatusForbidden)
+		return
+	}
+	pemCert, rawCert, err := signTLSClientCert(conf, csr, prof)
+	if err != nil {
+		log.Printf("acme finalize: failed to sign cert: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	cert, err := x509.ParseCertificate(rawCert)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	order.Status = "valid"
+	order.CSR = req.CSR
+	order.CertSerial = cert.SerialNumber.Text(16)
+	order.CertPEM = string(pemCert)
+	if err := dbPutACME(conf, conf.bucketNameACMEOrders, order.ID, order); err != nil {
+		log.Printf("Failed to persist finalized acme order: %v", err)
+	}
+
+	w.Header().Set("Location", acmeBaseURL(conf, r)+"/acme/order/"+order.ID)
+	writeJSON(w, http.StatusOK, order.view(conf, r))
+}
+
+// acmeOrderHandler returns the current state of an order.
+func acmeOrderHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+	orderID := strings.TrimPrefix(r.URL.Path, "/acme/order/")
+	var order acmeOrder
+	if found, err := dbGetACME(conf, conf.bucketNameACMEOrders, orderID, &order); err != nil || !found {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, order.view(conf, r))
+}
+
+// acmeCertificateHandler returns the PEM chain for a finalized order.
+func acmeCertificateHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if !acmeAuthorizedBroker(w, r, conf) {
+		return
+	}
+	orderID := strings.TrimPrefix(r.URL.Path, "/acme/certificate/")
+	var order acmeOrder
+	if found, err := dbGetACME(conf, conf.bucketNameACMEOrders, orderID, &order); err != nil || !found || order.Status != "valid" || order.CertPEM == "" {
+		http.Error(w, "Unknown or unfinalized order", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write([]byte(order.CertPEM))
+}
+
+func acmeBaseURL(conf *config, r *http.Request) string {
+	host := r.Host
+	if host == "" {
+		host = conf.SSLCertHostname
+		if conf.Port != 443 {
+			host = fmt.Sprintf("%s:%d", host, conf.Port)
+		}
+	}
+	return "https://" + host
+}
+
+func newACMEID(prefix string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return prefix + "-" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func dbPutACME(conf *config, bucket []byte, id string, v interface{}) error {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal acme object: %v", err)
+	}
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return fmt.Errorf("failed to open acme bucket %s: %v", bucket, err)
+		}
+		return b.Put([]byte(id), val)
+	})
+}
+
+func dbGetACME(conf *config, bucket []byte, id string, v interface{}) (bool, error) {
+	found := false
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		val := b.Get([]byte(id))
+		if val == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(val, v)
+	})
+	return found, err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// acmeJWK is the minimal JSON Web Key (RFC 7518 section 6) curse needs to verify RFC
+// 8555 request signatures: either an EC (ES256) or RSA (RS256) public key.
+type acmeJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// acmeJWSHeader is the protected header of a flattened RFC 7515 JWS, as RFC 8555
+// section 6.2 requires on every ACME POST: a fresh anti-replay nonce, the request's own
+// URL (so a signed request can't be replayed against a different endpoint), and either
+// an embedded jwk (newAccount, before curse knows an account's key) or a kid identifying
+// a previously registered account.
+type acmeJWSHeader struct {
+	Alg   string   `json:"alg"`
+	Nonce string   `json:"nonce"`
+	URL   string   `json:"url"`
+	JWK   *acmeJWK `json:"jwk,omitempty"`
+	Kid   string   `json:"kid,omitempty"`
+}
+
+// acmeJWS is the flattened JWS serialization (RFC 7515 appendix A.7) every ACME client
+// POSTs its requests as.
+type acmeJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// newACMENonce mints a fresh nonce and records it in conf.bucketNameACMENonces so
+// decodeACMEJWS can enforce RFC 8555 section 7.2's "used exactly once" requirement.
+func newACMENonce(conf *config) (string, error) {
+	nonce := newACMEID("nonce")
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(conf.bucketNameACMENonces)
+		if err != nil {
+			return fmt.Errorf("failed to open acme nonce bucket: %v", err)
+		}
+		return b.Put([]byte(nonce), []byte{1})
+	})
+	return nonce, err
+}
+
+// consumeACMENonce reports whether nonce was outstanding, deleting it in the same
+// transaction so it can't be replayed.
+func consumeACMENonce(conf *config, nonce string) (bool, error) {
+	found := false
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(conf.bucketNameACMENonces)
+		if err != nil {
+			return fmt.Errorf("failed to open acme nonce bucket: %v", err)
+		}
+		if b.Get([]byte(nonce)) == nil {
+			return nil
+		}
+		found = true
+		return b.Delete([]byte(nonce))
+	})
+	return found, err
+}
+
+// decodeACMEJWS parses r's body as a flattened JWS, verifies its signature against
+// either the embedded jwk (a new-account request) or the stored key for its kid (every
+// later request), checks and consumes its anti-replay nonce, and JSON-decodes the
+// payload into v. acct, if non-nil, receives the account the request authenticated as
+// (via kid) or is populated with the presented jwk (for a new-account request, whose
+// caller is responsible for filling in the rest of the account and persisting it).
+func decodeACMEJWS(r *http.Request, conf *config, v interface{}, acct *acmeAccount) error {
+	defer r.Body.Close()
+
+	var jws acmeJWS
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return fmt.Errorf("invalid jws envelope: %v", err)
+	}
+
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return fmt.Errorf("invalid jws protected header: %v", err)
+	}
+	var hdr acmeJWSHeader
+	if err := json.Unmarshal(protectedJSON, &hdr); err != nil {
+		return fmt.Errorf("invalid jws protected header: %v", err)
+	}
+
+	if used, err := consumeACMENonce(conf, hdr.Nonce); err != nil {
+		return fmt.Errorf("failed to check nonce: %v", err)
+	} else if !used {
+		return fmt.Errorf("nonce missing, expired or already used")
+	}
+
+	if wantURL := acmeBaseURL(conf, r) + r.URL.Path; hdr.URL != wantURL {
+		return fmt.Errorf("jws url %q does not match request url %q", hdr.URL, wantURL)
+	}
+
+	var pubKey crypto.PublicKey
+	switch {
+	case hdr.JWK != nil:
+		pubKey, err = hdr.JWK.publicKey()
+		if err != nil {
+			return fmt.Errorf("invalid jwk: %v", err)
+		}
+		if acct != nil {
+			acct.JWK = hdr.JWK
+		}
+	case hdr.Kid != "":
+		acctID := strings.TrimPrefix(hdr.Kid, acmeBaseURL(conf, r)+"/acme/account/")
+		var stored acmeAccount
+		if found, err := dbGetACME(conf, conf.bucketNameACMEAccounts, acctID, &stored); err != nil || !found {
+			return fmt.Errorf("unknown account in jws kid")
+		}
+		if stored.JWK == nil {
+			return fmt.Errorf("account %s has no registered key", acctID)
+		}
+		pubKey, err = stored.JWK.publicKey()
+		if err != nil {
+			return fmt.Errorf("invalid stored account jwk: %v", err)
+		}
+		if acct != nil {
+			*acct = stored
+		}
+	default:
+		return fmt.Errorf("jws protected header must set jwk or kid")
+	}
+
+	if err := verifyJWS(hdr.Alg, pubKey, jws.Protected, jws.Payload, jws.Signature); err != nil {
+		return fmt.Errorf("jws signature verification failed: %v", err)
+	}
+
+	if jws.Payload == "" {
+		return nil
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid jws payload: %v", err)
+	}
+	return json.Unmarshal(payloadJSON, v)
+}
+
+// verifyJWS checks sigB64 over "protectedB64.payloadB64" using alg and pubKey, per the
+// ES256/RS256 JWS signing algorithms (RFC 7518 section 3) that real ACME clients use.
+func verifyJWS(alg string, pubKey crypto.PublicKey, protectedB64, payloadB64, sigB64 string) error {
+	sig, err := base64.RawURLEncoding.DecodeString(sigB64)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	digest := sha256.Sum256([]byte(protectedB64 + "." + payloadB64))
+
+	switch alg {
+	case "ES256":
+		key, ok := pubKey.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwk does not match alg ES256")
+		}
+		if len(sig) != 64 {
+			return fmt.Errorf("unexpected ES256 signature length: %d", len(sig))
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return fmt.Errorf("signature does not verify")
+		}
+	case "RS256":
+		key, ok := pubKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwk does not match alg RS256")
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("signature does not verify: %v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported jws alg: %q", alg)
+	}
+
+	return nil
+}
+
+// publicKey decodes a JWK's EC or RSA public key per RFC 7518 section 6.
+func (k *acmeJWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "EC":
+		// Only P-256 is accepted: verifyJWS only implements ES256, so a P-384 (or
+		// other) key could be decoded here but could never pass signature
+		// verification - accepting it would just be dead code.
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported ec curve: %q", k.Crv)
+		}
+		curve := elliptic.P256()
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk x: %v", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk y: %v", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk n: %v", err)
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk e: %v", err)
+		}
+		e := 0
+		for _, b := range eBytes {
+			e = e<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: e}, nil
+	default:
+		return nil, fmt.Errorf("unsupported jwk kty: %q", k.Kty)
+	}
+}
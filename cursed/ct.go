@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/boltdb/bolt"
+	ct "github.com/google/certificate-transparency-go"
+	ctclient "github.com/google/certificate-transparency-go/client"
+	"github.com/google/certificate-transparency-go/ctutil"
+	"github.com/google/certificate-transparency-go/jsonclient"
+	"github.com/google/certificate-transparency-go/tls"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+)
+
+// ctLog is one entry of conf.CTLogs, naming a log to submit precertificates to and the
+// public key used to verify the SCTs it returns.
+type ctLog struct {
+	URI          string `mapstructure:"uri"`
+	Base64PubKey string `mapstructure:"base64_pubkey"`
+}
+
+// ctLogClient pairs a parsed ctLog config entry with its jsonclient and signature
+// verifier, built once at startup.
+type ctLogClient struct {
+	log      ctLog
+	client   *ctclient.LogClient
+	verifier *ct.SignatureVerifier
+}
+
+// submittedSCT is what gets persisted in conf.bucketNameSCTs, keyed by serial, so an
+// audit can reconstruct which log entries correspond to which issued cert.
+type submittedSCT struct {
+	LogURI    string    `json:"log_uri"`
+	Timestamp time.Time `json:"timestamp"`
+	SCT       []byte    `json:"sct"`
+}
+
+// loadCTLogs builds a ctLogClient (and signature verifier) for each entry in
+// conf.CTLogs. Called once at startup; a log that fails to parse is logged and skipped,
+// rather than failing the whole daemon.
+func loadCTLogs(conf *config) []ctLogClient {
+	clients := make([]ctLogClient, 0, len(conf.CTLogs))
+
+	for _, l := range conf.CTLogs {
+		pubKeyDER, err := base64.StdEncoding.DecodeString(l.Base64PubKey)
+		if err != nil {
+			log.Printf("failed to decode public key for ct log %s: %v", l.URI, err)
+			continue
+		}
+		pubKey, err := x509.ParsePKIXPublicKey(pubKeyDER)
+		if err != nil {
+			log.Printf("failed to parse public key for ct log %s: %v", l.URI, err)
+			continue
+		}
+
+		c, err := ctclient.New(l.URI, nil, jsonclient.Options{PublicKeyDER: pubKeyDER})
+		if err != nil {
+			log.Printf("failed to create ct log client for %s: %v", l.URI, err)
+			continue
+		}
+
+		sv, err := ct.NewSignatureVerifier(pubKey)
+		if err != nil {
+			log.Printf("failed to build signature verifier for ct log %s: %v", l.URI, err)
+			continue
+		}
+
+		clients = append(clients, ctLogClient{log: l, client: c, verifier: sv})
+	}
+
+	return clients
+}
+
+// signWithSCTs signs opts' certificate twice, the way RFC 6962 section 3.1 requires: a
+// certificate with an SCT list extension is only valid if that extension was present
+// when the CA signed it, since the extension lives inside the signed TBSCertificate.
+// Splicing SCTs into an already-signed DER (as an earlier version of this did via
+// ctutil.AddSCTsToX509Certificate) changes the signed bytes without updating the
+// signature over them, so every such certificate fails verification.
+//
+// Instead: tlsSignCert signs once to get a correctly-shaped template (the actual
+// signature on that first certificate is discarded, never returned to the caller), that
+// template is re-signed as a poisoned precertificate and submitted via add-pre-chain,
+// and once the real SCTs are known it is signed a second and final time with the SCT
+// list extension in place of the poison extension. Only that final certificate is
+// returned.
+func signWithSCTs(conf *config, opts certOpts, serial *big.Int) ([]byte, []byte, error) {
+	_, templateRaw, err := tlsSignCert(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate client cert template: %v", err)
+	}
+	template, err := x509.ParseCertificate(templateRaw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse client cert template: %v", err)
+	}
+
+	precertTemplate := *template
+	precertTemplate.ExtraExtensions = []pkix.Extension{ctPoisonExtension()}
+	precertDER, err := x509.CreateCertificate(rand.Reader, &precertTemplate, opts.CA, template.PublicKey, opts.CAKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign precertificate: %v", err)
+	}
+	precert, err := x509.ParseCertificate(precertDER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse precertificate: %v", err)
+	}
+
+	scts, err := submitPrecertToLogs(conf, serial.Text(16), precert, opts.CA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to submit client cert to ct logs: %v", err)
+	}
+	sctExt, err := ctSCTListExtension(scts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build sct list extension: %v", err)
+	}
+
+	finalTemplate := *template
+	finalTemplate.ExtraExtensions = []pkix.Extension{sctExt}
+	rawCert, err := x509.CreateCertificate(rand.Reader, &finalTemplate, opts.CA, template.PublicKey, opts.CAKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign final certificate: %v", err)
+	}
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCert})
+
+	return pemCert, rawCert, nil
+}
+
+// submitPrecertToLogs submits precert (issued by issuer) to every configured CT log via
+// add-pre-chain, verifies each returned SCT against that log's public key, and returns
+// their TLS-marshaled bytes ready for embedding. It fails the request if fewer than
+// conf.MinSCTs SCTs come back within conf.CTTimeout.
+func submitPrecertToLogs(conf *config, serial string, precert, issuer *x509.Certificate) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ctTimeout)
+	defer cancel()
+
+	var scts [][]byte
+	var persisted []submittedSCT
+
+	for _, l := range conf.ctLogs {
+		sctBytes, err := submitPrecert(ctx, l, precert, issuer)
+		if err != nil {
+			log.Printf("CT submission to %s failed: %v", l.log.URI, err)
+			continue
+		}
+		scts = append(scts, sctBytes)
+		persisted = append(persisted, submittedSCT{
+			LogURI:    l.log.URI,
+			Timestamp: time.Now(),
+			SCT:       sctBytes,
+		})
+	}
+
+	if len(scts) < conf.MinSCTs {
+		return nil, fmt.Errorf("only received %d/%d required scts before timeout", len(scts), conf.MinSCTs)
+	}
+
+	if err := dbPersistSCTs(conf, serial, persisted); err != nil {
+		log.Printf("failed to persist submitted scts for serial %s: %v", serial, err)
+	}
+
+	return scts, nil
+}
+
+// ctPoisonOID and ctSCTListOID are the extension OIDs RFC 6962 defines for, respectively,
+// a precertificate's poison extension (section 3.1) and a certificate's embedded SCT
+// list (section 3.3).
+var (
+	ctPoisonOID  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	ctSCTListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// ctPoisonExtension returns the critical, ASN.1 NULL-valued extension that marks a
+// certificate as a precertificate never meant to be trusted as-is.
+func ctPoisonExtension() pkix.Extension {
+	return pkix.Extension{Id: ctPoisonOID, Critical: true, Value: []byte{0x05, 0x00}}
+}
+
+// ctSCTListExtension TLS-encodes scts as a SignedCertificateTimestampList (RFC 6962
+// section 3.3) and ASN.1-wraps it for embedding as the certificate's SCT list extension.
+func ctSCTListExtension(scts [][]byte) (pkix.Extension, error) {
+	var list bytes.Buffer
+	for _, sct := range scts {
+		if len(sct) > 0xffff {
+			return pkix.Extension{}, fmt.Errorf("sct is too large to embed: %d bytes", len(sct))
+		}
+		if err := binary.Write(&list, binary.BigEndian, uint16(len(sct))); err != nil {
+			return pkix.Extension{}, err
+		}
+		list.Write(sct)
+	}
+	if list.Len() > 0xffff {
+		return pkix.Extension{}, fmt.Errorf("sct list is too large to embed: %d bytes", list.Len())
+	}
+
+	var framed bytes.Buffer
+	if err := binary.Write(&framed, binary.BigEndian, uint16(list.Len())); err != nil {
+		return pkix.Extension{}, err
+	}
+	framed.Write(list.Bytes())
+
+	value, err := asn1.Marshal(framed.Bytes())
+	if err != nil {
+		return pkix.Extension{}, fmt.Errorf("failed to asn1-encode sct list extension: %v", err)
+	}
+
+	return pkix.Extension{Id: ctSCTListOID, Value: value}, nil
+}
+
+// submitPrecert submits precert (issued by issuer) via add-pre-chain and verifies the
+// returned SCT's signature against the log's public key, returning the SCT's
+// TLS-marshaled bytes ready for embedding.
+func submitPrecert(ctx context.Context, l ctLogClient, precert, issuer *x509.Certificate) ([]byte, error) {
+	chain := []ct.ASN1Cert{{Data: precert.Raw}, {Data: issuer.Raw}}
+	sct, err := l.client.AddPreChain(ctx, chain)
+	if err != nil {
+		return nil, fmt.Errorf("add-pre-chain to %s failed: %v", l.log.URI, err)
+	}
+
+	// VerifySCTWithVerifier needs the chain as the CT library's own x509.Certificate
+	// type, not crypto/x509's, since it rebuilds the Merkle tree leaf from the
+	// precertificate's TBSCertificate bytes.
+	ctPrecert, err := ctx509.ParseCertificate(precert.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse precertificate for sct verification: %v", err)
+	}
+	ctIssuer, err := ctx509.ParseCertificate(issuer.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse issuer cert for sct verification: %v", err)
+	}
+	if err := ctutil.VerifySCTWithVerifier(l.verifier, []*ctx509.Certificate{ctPrecert, ctIssuer}, sct, false); err != nil {
+		return nil, fmt.Errorf("sct signature verification failed for %s: %v", l.log.URI, err)
+	}
+
+	sctBytes, err := tls.Marshal(*sct)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal sct from %s: %v", l.log.URI, err)
+	}
+
+	return sctBytes, nil
+}
+
+// dbPersistSCTs records every SCT submitted for serial in conf.bucketNameSCTs.
+func dbPersistSCTs(conf *config, serial string, scts []submittedSCT) error {
+	val, err := json.Marshal(scts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scts: %v", err)
+	}
+
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(conf.bucketNameSCTs)
+		if err != nil {
+			return fmt.Errorf("failed to open ctscts bucket: %v", err)
+		}
+		return b.Put([]byte(serial), val)
+	})
+}
@@ -0,0 +1,98 @@
+package keymanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// awsKMSKeyManager signs using an asymmetric ECC (P-256/P-384/P-521) signing key stored
+// in AWS KMS. The private key material never leaves KMS.
+type awsKMSKeyManager struct {
+	client *kms.KMS
+	keyID  string
+	pub    crypto.PublicKey
+}
+
+// newAWSKMSKeyManager builds a KeyManager from a uri of the form
+// "awskms:///alias/curse-ca" or "awskms://<key-id>".
+func newAWSKMSKeyManager(u *url.URL) (KeyManager, error) {
+	keyID := strings.TrimPrefix(u.Path, "/")
+	if keyID == "" {
+		keyID = u.Host
+	}
+	if keyID == "" {
+		return nil, fmt.Errorf("awskms uri missing key id: %s", u.String())
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %v", err)
+	}
+	client := kms.New(sess)
+
+	out, err := client.GetPublicKey(&kms.GetPublicKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch kms public key: %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kms public key: %v", err)
+	}
+	if _, ok := pub.(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("kms key %s is not an ecdsa key", keyID)
+	}
+
+	return &awsKMSKeyManager{client: client, keyID: keyID, pub: pub}, nil
+}
+
+func (a *awsKMSKeyManager) Public() crypto.PublicKey {
+	return a.pub
+}
+
+func (a *awsKMSKeyManager) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algo, err := ecdsaSigningAlgorithm(a.pub.(*ecdsa.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	out, err := a.client.Sign(&kms.SignInput{
+		KeyId:            aws.String(a.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(algo),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with kms: %v", err)
+	}
+	return out.Signature, nil
+}
+
+func (a *awsKMSKeyManager) Close() error {
+	return nil
+}
+
+// ecdsaSigningAlgorithm maps an ECDSA public key's curve to the KMS SigningAlgorithmSpec
+// that matches it. KMS rejects a Sign call whose SigningAlgorithm doesn't correspond to
+// the key's curve, so this must track whatever curve the CA key was actually created
+// with rather than assuming P-384.
+func ecdsaSigningAlgorithm(pub *ecdsa.PublicKey) (string, error) {
+	switch pub.Curve {
+	case elliptic.P256():
+		return kms.SigningAlgorithmSpecEcdsaSha256, nil
+	case elliptic.P384():
+		return kms.SigningAlgorithmSpecEcdsaSha384, nil
+	case elliptic.P521():
+		return kms.SigningAlgorithmSpecEcdsaSha512, nil
+	default:
+		return "", fmt.Errorf("unsupported kms ecdsa curve: %s", pub.Curve.Params().Name)
+	}
+}
@@ -0,0 +1,69 @@
+package keymanager
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fileKeyManager signs with a private key read from disk once at construction time. It
+// is the default backend and matches the behavior curse always had before keymanager
+// existed: an EC PEM key for the TLS CA, or an OpenSSH-format key for the SSH CA.
+type fileKeyManager struct {
+	key crypto.Signer
+}
+
+func newFileKeyManager(u *url.URL) (KeyManager, error) {
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+
+	keyPem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+
+	key, err := parsePrivateKey(keyPem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %v", path, err)
+	}
+
+	return &fileKeyManager{key: key}, nil
+}
+
+// parsePrivateKey accepts either the "EC PRIVATE KEY" PEM curse's TLS CA has always
+// used, or an OpenSSH-format private key like the SSH CA key.
+func parsePrivateKey(keyPem []byte) (crypto.Signer, error) {
+	if block, _ := pem.Decode(keyPem); block != nil && block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	raw, err := ssh.ParseRawPrivateKey(keyPem)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := raw.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key type %T does not implement crypto.Signer", raw)
+	}
+	return signer, nil
+}
+
+func (f *fileKeyManager) Public() crypto.PublicKey {
+	return f.key.Public()
+}
+
+func (f *fileKeyManager) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return f.key.Sign(rand, digest, opts)
+}
+
+func (f *fileKeyManager) Close() error {
+	return nil
+}
@@ -0,0 +1,76 @@
+// Package keymanager abstracts where a CA private key actually lives. Callers get back
+// a KeyManager that exposes only Sign/Public/Close, so code that signs certificates
+// never has to hold (or even see) raw private key bytes. This lets the CA root live on
+// disk, in a PKCS#11 token/HSM, behind a cloud KMS, or in an ssh-agent, selected purely
+// by the URI passed to New.
+package keymanager
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"net/url"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyManager is satisfied by every backend. Its method set matches crypto.Signer plus
+// Close, so any KeyManager value can also be used directly as a crypto.Signer.
+type KeyManager interface {
+	Public() crypto.PublicKey
+	Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+	Close() error
+}
+
+// NewFile loads the file backend directly from a filesystem path, bypassing URL
+// parsing entirely. Callers that fall back to a bare path (curse's pre-keymanager
+// default, e.g. conf.CAKeyFile/conf.SSLKey with no kms URI configured) must use this
+// instead of New("file://"+path): url.Parse treats the first path segment of a
+// relative path as a host, silently reading the wrong file.
+func NewFile(path string) (KeyManager, error) {
+	return newFileKeyManager(&url.URL{Path: path})
+}
+
+// New parses uri and returns the KeyManager backend it selects.
+//
+// Supported schemes:
+//
+//	file://<path>                                    raw PEM key on disk (default)
+//	pkcs11:token=<label>;object=<label>?pin-value=... PKCS#11 token/HSM
+//	awskms:///alias/<name> or awskms://<key-id>       AWS KMS asymmetric signing key
+//	sshagent://                                       key held by a running ssh-agent
+func New(uri string) (KeyManager, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kms uri %q: %v", uri, err)
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		return newFileKeyManager(u)
+	case "pkcs11":
+		return newPKCS11KeyManager(uri)
+	case "awskms":
+		return newAWSKMSKeyManager(u)
+	case "sshagent":
+		return newSSHAgentKeyManager(u)
+	default:
+		return nil, fmt.Errorf("unsupported kms scheme: %q", u.Scheme)
+	}
+}
+
+// sshSignerProvider is implemented by backends (currently sshagent) that hold an
+// ssh.Signer directly instead of a crypto.Signer.
+type sshSignerProvider interface {
+	SSHSigner() ssh.Signer
+}
+
+// SSHSigner adapts any KeyManager into an ssh.Signer for the SSH CA path. Backends that
+// already hold an ssh.Signer (sshagent) return it unchanged; crypto.Signer-backed
+// backends (file/pkcs11/awskms) are wrapped with ssh.NewSignerFromSigner.
+func SSHSigner(km KeyManager) (ssh.Signer, error) {
+	if p, ok := km.(sshSignerProvider); ok {
+		return p.SSHSigner(), nil
+	}
+	return ssh.NewSignerFromSigner(km)
+}
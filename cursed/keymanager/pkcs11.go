@@ -0,0 +1,219 @@
+package keymanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11KeyManager signs using a key held in a PKCS#11 token/HSM (e.g. a YubiHSM or
+// SoftHSM slot). The private key handle never leaves the token.
+type pkcs11KeyManager struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	privKey pkcs11.ObjectHandle
+	pub     *ecdsa.PublicKey
+}
+
+// newPKCS11KeyManager parses a uri of the form
+// "pkcs11:token=<label>;object=<label>?pin-value=<pin>&module=<path-to-.so>".
+func newPKCS11KeyManager(uri string) (KeyManager, error) {
+	opaque := strings.TrimPrefix(uri, "pkcs11:")
+	pathPart, queryPart := opaque, ""
+	if i := strings.Index(opaque, "?"); i >= 0 {
+		pathPart, queryPart = opaque[:i], opaque[i+1:]
+	}
+
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(pathPart, ";") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			attrs[parts[0]] = parts[1]
+		}
+	}
+	query, err := url.ParseQuery(queryPart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pkcs11 uri query: %v", err)
+	}
+
+	module := query.Get("module")
+	if module == "" {
+		module = "/usr/lib/softhsm/libsofthsm2.so"
+	}
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load pkcs11 module: %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialize pkcs11 module: %v", err)
+	}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		return nil, fmt.Errorf("failed to find a pkcs11 slot for token %q: %v", attrs["token"], err)
+	}
+	slot, found := slots[0], attrs["token"] == ""
+	for _, s := range slots {
+		if found {
+			break
+		}
+		if info, err := ctx.GetTokenInfo(s); err == nil && strings.TrimRight(info.Label, " \x00") == attrs["token"] {
+			slot, found = s, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("failed to find a pkcs11 slot for token %q", attrs["token"])
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pkcs11 session: %v", err)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, query.Get("pin-value")); err != nil {
+		return nil, fmt.Errorf("failed to login to pkcs11 token: %v", err)
+	}
+
+	label := attrs["object"]
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := ctx.FindObjectsInit(session, tmpl); err != nil {
+		return nil, fmt.Errorf("failed to look up pkcs11 object %q: %v", label, err)
+	}
+	handles, _, err := ctx.FindObjects(session, 1)
+	ctx.FindObjectsFinal(session)
+	if err != nil || len(handles) == 0 {
+		return nil, fmt.Errorf("no pkcs11 private key object found for label %q", label)
+	}
+
+	pub, err := findPublicKey(ctx, session, label)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find matching pkcs11 public key: %v", err)
+	}
+
+	return &pkcs11KeyManager{
+		ctx:     ctx,
+		session: session,
+		privKey: handles[0],
+		pub:     pub,
+	}, nil
+}
+
+// findPublicKey looks up the CKO_PUBLIC_KEY object sharing label and decodes its EC
+// point into an *ecdsa.PublicKey.
+func findPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (*ecdsa.PublicKey, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := ctx.FindObjectsInit(session, tmpl); err != nil {
+		return nil, err
+	}
+	handles, _, err := ctx.FindObjects(session, 1)
+	ctx.FindObjectsFinal(session)
+	if err != nil || len(handles) == 0 {
+		return nil, fmt.Errorf("no pkcs11 public key object found for label %q", label)
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, handles[0], []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+	})
+	if err != nil || len(attrs) == 0 {
+		return nil, fmt.Errorf("failed to read CKA_EC_POINT: %v", err)
+	}
+
+	curve, err := curveFromECParams(attrs[1].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	x, y := elliptic.Unmarshal(curve, attrs[0].Value)
+	if x == nil {
+		return nil, fmt.Errorf("failed to unmarshal ec point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// namedCurveOIDs maps the DER-encoded OBJECT IDENTIFIER a PKCS#11 token reports in
+// CKA_EC_PARAMS to the elliptic.Curve it names, covering the NIST curves curse's
+// signing profiles already know how to express (see profiles.go's Curves field).
+var namedCurveOIDs = map[string]elliptic.Curve{
+	asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}.String(): elliptic.P256(),
+	asn1.ObjectIdentifier{1, 3, 132, 0, 34}.String():          elliptic.P384(),
+	asn1.ObjectIdentifier{1, 3, 132, 0, 35}.String():          elliptic.P521(),
+}
+
+// curveFromECParams decodes a PKCS#11 CKA_EC_PARAMS value (a DER-encoded namedCurve
+// OBJECT IDENTIFIER) into the matching elliptic.Curve, so findPublicKey can unmarshal
+// CKA_EC_POINT with the token's actual curve instead of assuming P-384.
+func curveFromECParams(ecParams []byte) (elliptic.Curve, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(ecParams, &oid); err != nil {
+		return nil, fmt.Errorf("failed to parse CKA_EC_PARAMS: %v", err)
+	}
+	curve, ok := namedCurveOIDs[oid.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported pkcs11 ec curve oid: %s", oid.String())
+	}
+	return curve, nil
+}
+
+func (p *pkcs11KeyManager) Public() crypto.PublicKey {
+	return p.pub
+}
+
+// Sign asks the token to sign digest with ECDSA using the private key handle found at
+// construction time. The raw private key material never leaves the device.
+//
+// CKM_ECDSA returns the raw, fixed-width r||s pair rather than the ASN.1 DER
+// SEQUENCE{r, s} that crypto.Signer callers (x509, CRL, OCSP signing) expect, so this
+// splits the token's output in half and re-encodes it before returning.
+func (p *pkcs11KeyManager) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+	if err := p.ctx.SignInit(p.session, mech, p.privKey); err != nil {
+		return nil, fmt.Errorf("failed to init pkcs11 sign: %v", err)
+	}
+	sig, err := p.ctx.Sign(p.session, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with pkcs11 token: %v", err)
+	}
+
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, fmt.Errorf("unexpected pkcs11 ecdsa signature length: %d", len(sig))
+	}
+	n := len(sig) / 2
+	ecdsaSig := struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(sig[:n]),
+		S: new(big.Int).SetBytes(sig[n:]),
+	}
+
+	der, err := asn1.Marshal(ecdsaSig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to der-encode pkcs11 signature: %v", err)
+	}
+	return der, nil
+}
+
+func (p *pkcs11KeyManager) Close() error {
+	p.ctx.Logout(p.session)
+	p.ctx.CloseSession(p.session)
+	p.ctx.Finalize()
+	p.ctx.Destroy()
+	return nil
+}
@@ -0,0 +1,95 @@
+package keymanager
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentKeyManager delegates signing to a key already loaded in a running ssh-agent,
+// reached over $SSH_AUTH_SOCK. It is primarily meant for the SSH CA signer, which wants
+// an ssh.Signer rather than a crypto.Signer; Sign/Public below exist only to satisfy
+// KeyManager. Public returns the selected agent key's ssh.PublicKey and Sign always
+// fails. The selected key is the agent's first identity, or the one whose comment
+// matches the uri's key parameter.
+type sshAgentKeyManager struct {
+	conn   net.Conn
+	agent  agent.Agent
+	signer ssh.Signer
+}
+
+// newSSHAgentKeyManager builds a KeyManager from a uri of the form "sshagent://",
+// optionally "sshagent://?key=<comment>" to disambiguate when the agent holds more
+// than one identity.
+func newSSHAgentKeyManager(u *url.URL) (KeyManager, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set, cannot reach ssh-agent")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+	a := agent.NewClient(conn)
+
+	wantComment := u.Query().Get("key")
+	signers, err := a.Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to list ssh-agent keys: %v", err)
+	}
+	if len(signers) == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("ssh-agent holds no keys")
+	}
+
+	signer := signers[0]
+	if wantComment != "" {
+		keys, err := a.List()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to list ssh-agent identities: %v", err)
+		}
+		found := false
+		for i, k := range keys {
+			if k.Comment == wantComment && i < len(signers) {
+				signer = signers[i]
+				found = true
+				break
+			}
+		}
+		if !found {
+			conn.Close()
+			return nil, fmt.Errorf("no ssh-agent key with comment %q", wantComment)
+		}
+	}
+
+	return &sshAgentKeyManager{conn: conn, agent: a, signer: signer}, nil
+}
+
+// SSHSigner returns the underlying ssh.Signer directly, for the SSH CA path which
+// signs certificates with golang.org/x/crypto/ssh rather than crypto/x509.
+func (s *sshAgentKeyManager) SSHSigner() ssh.Signer {
+	return s.signer
+}
+
+func (s *sshAgentKeyManager) Public() crypto.PublicKey {
+	return s.signer.PublicKey()
+}
+
+// Sign is not supported for ssh-agent keys: the agent only implements the SSH wire
+// signature format, not crypto.Signer's ASN.1 digest signing. Callers that need the SSH
+// CA key should use SSHSigner instead.
+func (s *sshAgentKeyManager) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, fmt.Errorf("sshagent keys do not support crypto.Signer.Sign, use SSHSigner")
+}
+
+func (s *sshAgentKeyManager) Close() error {
+	return s.conn.Close()
+}
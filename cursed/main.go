@@ -1,42 +1,74 @@
 package main
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"crypto/x509"
 	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/boltdb/bolt"
+	"github.com/schatt/curse/cursed/keymanager"
 	"github.com/spf13/viper"
 )
 
 type config struct {
-	brokerFP         []byte
-	bucketNameFP     []byte
-	bucketNameSerial []byte
-	db               *bolt.DB
-	dur              time.Duration
-	exts             map[string]string
-	keyLifeSpan      time.Duration
-	sshCASigner      ssh.Signer
-	tlsDur           time.Duration
-	tlsCACert        *x509.Certificate
-	tlsCAKey         *ecdsa.PrivateKey
-	userRegex        *regexp.Regexp
+	brokerFP                 []byte
+	bucketNameFP             []byte
+	bucketNameSerial         []byte
+	bucketNameRevocations    []byte
+	bucketNameIdentitySerial []byte
+	bucketNameSCTs           []byte
+	bucketNameACMEAccounts   []byte
+	bucketNameACMEOrders     []byte
+	bucketNameACMEAuthzs     []byte
+	bucketNameACMENonces     []byte
+	db                       *bolt.DB
+	dur                      time.Duration
+	exts                     map[string]string
+	keyLifeSpan              time.Duration
+	sshKeyManager            keymanager.KeyManager
+	sshCASigner              ssh.Signer
+	tlsDur                   time.Duration
+	tlsCACert                *x509.Certificate
+	tlsKeyManager            keymanager.KeyManager
+	tlsCAKey                 crypto.Signer
+	userRegex                *regexp.Regexp
+
+	crlInterval time.Duration
+	crlMu       sync.RWMutex
+	cachedCRL   []byte
+	cachedKRL   []byte
+
+	// caMu guards tlsCAKey/tlsCACert/sshCASigner, which reloader.reload() swaps out from
+	// under a running signer on SIGHUP or a watched file changing.
+	caMu sync.RWMutex
+
+	ctLogs    []ctLogClient
+	ctTimeout time.Duration
+
+	profiles map[string]profile
 
 	Addr              string
 	CAKeyFile         string
+	CRLInterval       int
+	CTLogs            []ctLog
+	CTTimeout         int
 	DBFile            string
 	Duration          int
 	Extensions        []string
 	ForceCmd          bool
+	GroupsHeader      string
 	MaxKeyAge         int
+	MinSCTs           int
 	Port              int
+	Profiles          map[string]profile
 	RequireClientIP   bool
 	SSLBrokerCert     string
 	SSLBrokerHostname string
@@ -48,6 +80,8 @@ type config struct {
 	SSLKey            string
 	SSLKeyCurve       string
 	SSLDuration       int
+	SSLKMS            string
+	SSHKMS            string
 	UserHeader        string
 }
 
@@ -75,11 +109,28 @@ func main() {
 		conf.tlsDur = time.Duration(conf.SSLDuration) * time.Second
 	}
 
-	// Load the CA key into an ssh.Signer
-	conf.sshCASigner, err = loadSSHCAKey(conf.CAKeyFile)
+	// Convert our CRL/KRL regeneration interval from int to time.Duration
+	conf.crlInterval = time.Duration(conf.CRLInterval) * time.Minute
+
+	// Build clients for any configured CT logs
+	conf.ctTimeout = time.Duration(conf.CTTimeout) * time.Second
+	conf.ctLogs = loadCTLogs(conf)
+
+	// Load the SSH CA key behind a KeyManager, so the signer never sees raw key bytes
+	// once it's backed by a PKCS#11/KMS/ssh-agent URI instead of a file
+	if conf.SSHKMS == "" {
+		conf.sshKeyManager, err = keymanager.NewFile(conf.CAKeyFile)
+	} else {
+		conf.sshKeyManager, err = keymanager.New(conf.SSHKMS)
+	}
+	if err != nil {
+		log.Fatalf("failed to load ssh ca key: %v", err)
+	}
+	conf.sshCASigner, err = keymanager.SSHSigner(conf.sshKeyManager)
 	if err != nil {
-		log.Fatalf("%v", err)
+		log.Fatalf("failed to build ssh ca signer: %v", err)
 	}
+	defer conf.sshKeyManager.Close()
 
 	// Open our key tracking database file
 	conf.db, err = bolt.Open(conf.DBFile, 0600, nil)
@@ -96,6 +147,9 @@ func main() {
 	if err != nil {
 		log.Printf("%v", err)
 	}
+	if conf.tlsKeyManager != nil {
+		defer conf.tlsKeyManager.Close()
+	}
 
 	// Get a fingerprint of the broker cert to restrict certificate signing
 	conf.brokerFP, err = getBrokerFP(conf)
@@ -113,12 +167,72 @@ func main() {
 		tlsCertHandler(w, r, conf)
 	})
 
+	// Set our web handler function
+	http.HandleFunc("/revoke/", func(w http.ResponseWriter, r *http.Request) {
+		revokeCertHandler(w, r, conf)
+	})
+
+	// Serve the most recently generated CRL/KRL and answer OCSP queries
+	http.HandleFunc("/crl", func(w http.ResponseWriter, r *http.Request) {
+		crlHandler(w, r, conf)
+	})
+	http.HandleFunc("/krl", func(w http.ResponseWriter, r *http.Request) {
+		krlHandler(w, r, conf)
+	})
+	http.HandleFunc("/ocsp", func(w http.ResponseWriter, r *http.Request) {
+		ocspHandler(w, r, conf)
+	})
+
+	// ACME (RFC 8555) surface, so standard clients can get bastion-authenticated certs
+	// without speaking curse's custom CSR-over-form protocol
+	http.HandleFunc("/acme/directory", func(w http.ResponseWriter, r *http.Request) {
+		acmeDirectoryHandler(w, r, conf)
+	})
+	http.HandleFunc("/acme/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		acmeNewNonceHandler(w, r, conf)
+	})
+	http.HandleFunc("/acme/new-account", func(w http.ResponseWriter, r *http.Request) {
+		acmeNewAccountHandler(w, r, conf)
+	})
+	http.HandleFunc("/acme/new-order", func(w http.ResponseWriter, r *http.Request) {
+		acmeNewOrderHandler(w, r, conf)
+	})
+	http.HandleFunc("/acme/authz/", func(w http.ResponseWriter, r *http.Request) {
+		acmeAuthzHandler(w, r, conf)
+	})
+	http.HandleFunc("/acme/challenge/", func(w http.ResponseWriter, r *http.Request) {
+		acmeChallengeHandler(w, r, conf)
+	})
+	http.HandleFunc("/acme/order/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/finalize") {
+			acmeFinalizeHandler(w, r, conf)
+			return
+		}
+		acmeOrderHandler(w, r, conf)
+	})
+	http.HandleFunc("/acme/certificate/", func(w http.ResponseWriter, r *http.Request) {
+		acmeCertificateHandler(w, r, conf)
+	})
+
+	// Regenerate the signed CRL and KRL in the background
+	go startCRLUpdater(conf)
+
 	// Prepare our TLS settings
 	addrPort := fmt.Sprintf("%s:%d", conf.Addr, conf.Port)
 	tlsConf, err := getTLSConfig(conf)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Let the server pick up a rotated server cert/CA pool without a restart
+	reload, err := newReloader(conf, tlsConf)
+	if err != nil {
+		log.Fatalf("failed to start reloader: %v", err)
+	}
+	tlsConf.GetCertificate = reload.GetCertificate
+	tlsConf.GetConfigForClient = reload.GetConfigForClient
+	go reload.watch()
+
 	server := &http.Server{
 		Addr:      addrPort,
 		TLSConfig: tlsConf,
@@ -150,11 +264,17 @@ func init() {
 
 	viper.SetDefault("addr", "127.0.0.1")
 	viper.SetDefault("cakeyfile", "/opt/curse/etc/user_ca")
+	viper.SetDefault("crlinterval", 60) // regenerate CRL/KRL every 60 minutes
+	viper.SetDefault("ctlogs", []map[string]string{})
+	viper.SetDefault("cttimeout", 10) // seconds to wait for SCTs before failing issuance
 	viper.SetDefault("dbfile", "/opt/curse/etc/cursed.db")
 	viper.SetDefault("duration", 2*60) // 2 minute default
 	viper.SetDefault("extensions", []string{"permit-pty"})
 	viper.SetDefault("forcecmd", false)
+	viper.SetDefault("groupsheader", "REMOTE_GROUPS")
 	viper.SetDefault("maxkeyage", 90) // 90 day default
+	viper.SetDefault("minscts", 0)    // 0 disables the ct requirement
+	viper.SetDefault("profiles", map[string]interface{}{})
 	viper.SetDefault("port", 81)
 	viper.SetDefault("requireclientip", true)
 	viper.SetDefault("sslbrokercert", "/opt/curse/etc/broker.crt")
@@ -167,6 +287,8 @@ func init() {
 	viper.SetDefault("sslkey", "/opt/curse/etc/cursed.key")
 	viper.SetDefault("sslkeycurve", "p384")
 	viper.SetDefault("sslduration", 12*60) // 12 hour default
+	viper.SetDefault("sslkms", "")         // empty means the file backend reading sslkey
+	viper.SetDefault("sshkms", "")         // empty means the file backend reading cakeyfile
 	viper.SetDefault("userheader", "REMOTE_USER")
 }
 
@@ -207,6 +329,13 @@ func getConf() (*config, error) {
 	// Hardcoding the DB bucket name
 	conf.bucketNameFP = []byte("pubkeybirthdays")
 	conf.bucketNameSerial = []byte("certserial")
+	conf.bucketNameRevocations = []byte("certrevocations")
+	conf.bucketNameIdentitySerial = []byte("certidentityserial")
+	conf.bucketNameSCTs = []byte("ctscts")
+	conf.bucketNameACMEAccounts = []byte("acmeaccounts")
+	conf.bucketNameACMEOrders = []byte("acmeorders")
+	conf.bucketNameACMEAuthzs = []byte("acmeauthzs")
+	conf.bucketNameACMENonces = []byte("acmenonces")
 
 	// Require TLS mutual authentication for security
 	if conf.SSLCA == "" || conf.SSLKey == "" || conf.SSLCert == "" {
@@ -230,5 +359,11 @@ func getConf() (*config, error) {
 	// With TLS mutual auth, the certificate fingerprint is used in place of a username ($ssl_client_fingerprint in nginx)
 	conf.userRegex = regexp.MustCompile(`(?i)^([a-z_][a-z0-9_-]{0,31}|[a-f0-9]+)$`)
 
+	// Validate our signing profiles fail fast at startup, same as cfssl's cfg.Valid()
+	conf.profiles, err = loadProfiles(&conf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid profiles: %v", err)
+	}
+
 	return &conf, nil
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// profile is a cfssl-style signing policy: a named bundle of validity and constraint
+// rules that sshCertHandler/tlsCertHandler select between via the "profile" form field.
+// "default" always exists and preserves curse's historical single-policy behavior.
+//
+// DurationSeconds/MaxDurationSeconds are config-file ints, matching how every other
+// duration in this package is expressed; loadProfiles converts them to Duration/
+// MaxDuration once at startup.
+type profile struct {
+	DurationSeconds    int `mapstructure:"duration"`
+	MaxDurationSeconds int `mapstructure:"max_duration"`
+	Duration           time.Duration
+	MaxDuration        time.Duration
+
+	// SSH constraints. Not currently enforced (see loadProfiles) since sshCertHandler
+	// isn't part of this checkout to wire them into; loadProfiles rejects any profile
+	// that sets these until it lands.
+	Extensions []string `mapstructure:"extensions"`
+	Principals []string `mapstructure:"principals"`
+
+	// TLS constraints
+	KeyUsages     []string `mapstructure:"key_usages"`
+	ExtKeyUsages  []string `mapstructure:"ext_key_usages"`
+	KeyAlgorithms []string `mapstructure:"key_algorithms"`
+	Curves        []string `mapstructure:"curves"`
+
+	Claims claims `mapstructure:"claims"`
+}
+
+// claims restricts who may request a profile. Empty fields mean "no restriction" for
+// that dimension.
+type claims struct {
+	Users  []string `mapstructure:"users"`
+	Groups []string `mapstructure:"groups"`
+	CIDRs  []string `mapstructure:"cidrs"`
+
+	cidrNets []*net.IPNet
+}
+
+// loadProfiles validates conf.Profiles the way cfssl's cfg.Valid() does: it fails fast
+// at startup if a profile is malformed or references a CIDR that doesn't parse, rather
+// than rejecting requests at signing time.
+func loadProfiles(conf *config) (map[string]profile, error) {
+	profiles := conf.Profiles
+	if profiles == nil {
+		profiles = map[string]profile{}
+	}
+
+	// extensions/principals aren't enforced anywhere: validateSSHExtensions/
+	// validateSSHPrincipals were dropped in 9a36e4a because sshCertHandler isn't part of
+	// this checkout, and nothing else reads these fields. Configuring either silently
+	// believing they restrict something would be misleading, so reject them at startup
+	// until the SSH side lands instead.
+	for name, p := range profiles {
+		if len(p.Extensions) > 0 {
+			return nil, fmt.Errorf("profile %q: extensions is not currently enforced, remove it", name)
+		}
+		if len(p.Principals) > 0 {
+			return nil, fmt.Errorf("profile %q: principals is not currently enforced, remove it", name)
+		}
+	}
+
+	// "default" preserves curse's historical behavior: whatever duration/extensions are
+	// configured daemon-wide, with no additional principal/claims restrictions. A zero
+	// Duration/MaxDuration tells signTLSClientCert/sshCertHandler to fall back to
+	// conf.tlsDur/conf.dur, which aren't computed yet at this point in startup.
+	if _, ok := profiles["default"]; !ok {
+		profiles["default"] = profile{
+			Extensions: conf.Extensions,
+		}
+	}
+
+	for name, p := range profiles {
+		if p.DurationSeconds > 0 {
+			p.Duration = time.Duration(p.DurationSeconds) * time.Second
+		}
+		if p.MaxDurationSeconds > 0 {
+			p.MaxDuration = time.Duration(p.MaxDurationSeconds) * time.Second
+		}
+		if p.MaxDuration == 0 {
+			p.MaxDuration = p.Duration
+		}
+		if p.Duration > p.MaxDuration {
+			return nil, fmt.Errorf("profile %q: duration exceeds max_duration", name)
+		}
+
+		for _, cidr := range p.Claims.CIDRs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: invalid claims cidr %q: %v", name, cidr, err)
+			}
+			p.Claims.cidrNets = append(p.Claims.cidrNets, ipNet)
+		}
+
+		profiles[name] = p
+	}
+
+	return profiles, nil
+}
+
+// selectProfile picks the profile named by form (defaulting to "default") and checks
+// that user/groups/sourceIP satisfy its claims.
+func selectProfile(conf *config, name, user string, groups []string, sourceIP string) (profile, error) {
+	if name == "" {
+		name = "default"
+	}
+
+	p, ok := conf.profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("unknown profile: %q", name)
+	}
+
+	if err := p.Claims.allows(user, groups, sourceIP); err != nil {
+		return profile{}, fmt.Errorf("profile %q: %v", name, err)
+	}
+
+	return p, nil
+}
+
+// allows reports whether user/groups/sourceIP satisfy every non-empty claim dimension.
+func (c claims) allows(user string, groups []string, sourceIP string) error {
+	if len(c.Users) > 0 && !contains(c.Users, user) {
+		return fmt.Errorf("user %q is not permitted by this profile's claims", user)
+	}
+
+	if len(c.Groups) > 0 {
+		allowed := false
+		for _, g := range groups {
+			if contains(c.Groups, g) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("none of user %q's groups are permitted by this profile's claims", user)
+		}
+	}
+
+	if len(c.cidrNets) > 0 {
+		ip := net.ParseIP(sourceIP)
+		if ip == nil {
+			return fmt.Errorf("source ip %q is not parseable", sourceIP)
+		}
+		allowed := false
+		for _, ipNet := range c.cidrNets {
+			if ipNet.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("source ip %q is not permitted by this profile's claims", sourceIP)
+		}
+	}
+
+	return nil
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// oidKeyUsage and oidExtKeyUsage are the X.509 extension OIDs a CSR's requested key
+// usage / extended key usage (RFC 2986 extensionRequest attribute) are carried under.
+var (
+	oidKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// keyUsageNames maps the config file's key_usages strings to their x509.KeyUsage bit.
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digitalsignature":  x509.KeyUsageDigitalSignature,
+	"contentcommitment": x509.KeyUsageContentCommitment,
+	"keyencipherment":   x509.KeyUsageKeyEncipherment,
+	"dataencipherment":  x509.KeyUsageDataEncipherment,
+	"keyagreement":      x509.KeyUsageKeyAgreement,
+	"certsign":          x509.KeyUsageCertSign,
+	"crlsign":           x509.KeyUsageCRLSign,
+	"encipheronly":      x509.KeyUsageEncipherOnly,
+	"decipheronly":      x509.KeyUsageDecipherOnly,
+}
+
+// ekuOIDNames maps the config file's ext_key_usages strings to their OID, covering the
+// extended key usages curse's signing profiles have any reason to restrict.
+var ekuOIDNames = map[string]asn1.ObjectIdentifier{
+	"serverauth":      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	"clientauth":      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	"codesigning":     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	"emailprotection": {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	"timestamping":    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	"ocspsigning":     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+}
+
+// validateTLSKeyUsage rejects a CSR whose requested key algorithm, curve, key usage or
+// extended key usage falls outside what the profile allows. A dimension with no entries
+// in the profile permits anything for that dimension, matching curse's historical
+// single-policy behavior.
+func (p profile) validateTLSKeyUsage(csr *x509.CertificateRequest) error {
+	if len(p.KeyAlgorithms) > 0 {
+		algo := strings.ToLower(csr.PublicKeyAlgorithm.String())
+		if !contains(lower(p.KeyAlgorithms), algo) {
+			return fmt.Errorf("key algorithm %q is not permitted by this profile", algo)
+		}
+	}
+
+	if len(p.Curves) > 0 {
+		ecdsaKey, ok := csr.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("this profile restricts curves, but the csr's key is not ecdsa")
+		}
+		curve := strings.ToLower(ecdsaKey.Curve.Params().Name)
+		if !contains(lower(p.Curves), curve) {
+			return fmt.Errorf("curve %q is not permitted by this profile", curve)
+		}
+	}
+
+	for _, ext := range csr.Extensions {
+		switch {
+		case ext.Id.Equal(oidKeyUsage):
+			if len(p.KeyUsages) == 0 {
+				continue
+			}
+			usage, err := parseRequestedKeyUsage(ext)
+			if err != nil {
+				return fmt.Errorf("failed to parse requested key usage: %v", err)
+			}
+			if err := checkKeyUsage(usage, p.KeyUsages); err != nil {
+				return err
+			}
+		case ext.Id.Equal(oidExtKeyUsage):
+			if len(p.ExtKeyUsages) == 0 {
+				continue
+			}
+			oids, err := parseRequestedExtKeyUsage(ext)
+			if err != nil {
+				return fmt.Errorf("failed to parse requested ext key usage: %v", err)
+			}
+			if err := checkExtKeyUsage(oids, p.ExtKeyUsages); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkKeyUsage rejects requested if it sets any bit outside what allowedNames permits.
+func checkKeyUsage(requested x509.KeyUsage, allowedNames []string) error {
+	var allowed x509.KeyUsage
+	for _, name := range allowedNames {
+		bit, ok := keyUsageNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown key usage in profile: %q", name)
+		}
+		allowed |= bit
+	}
+	if requested&^allowed != 0 {
+		return fmt.Errorf("requested key usage is not permitted by this profile")
+	}
+	return nil
+}
+
+// checkExtKeyUsage rejects requested if it contains any EKU outside what allowedNames
+// permits.
+func checkExtKeyUsage(requested []asn1.ObjectIdentifier, allowedNames []string) error {
+	for _, oid := range requested {
+		permitted := false
+		for _, name := range allowedNames {
+			if allowedOID, ok := ekuOIDNames[strings.ToLower(name)]; ok && oid.Equal(allowedOID) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return fmt.Errorf("requested extended key usage %v is not permitted by this profile", oid)
+		}
+	}
+	return nil
+}
+
+// parseRequestedKeyUsage decodes a CSR's requested key usage extension (a BIT STRING)
+// into the equivalent x509.KeyUsage bitmask.
+func parseRequestedKeyUsage(ext pkix.Extension) (x509.KeyUsage, error) {
+	var bits asn1.BitString
+	if _, err := asn1.Unmarshal(ext.Value, &bits); err != nil {
+		return 0, err
+	}
+	var usage x509.KeyUsage
+	for i := 0; i < 9; i++ {
+		if bits.At(i) != 0 {
+			usage |= 1 << uint(i)
+		}
+	}
+	return usage, nil
+}
+
+// parseRequestedExtKeyUsage decodes a CSR's requested extended key usage extension (a
+// SEQUENCE OF OBJECT IDENTIFIER) into its OIDs.
+func parseRequestedExtKeyUsage(ext pkix.Extension) ([]asn1.ObjectIdentifier, error) {
+	var oids []asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(ext.Value, &oids); err != nil {
+		return nil, err
+	}
+	return oids, nil
+}
+
+func lower(ss []string) []string {
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
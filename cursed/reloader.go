@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/schatt/curse/cursed/keymanager"
+)
+
+// reloader atomically swaps the CA material and server certificate/key used by
+// signTLSClientCert, the SSH signer and the running http.Server, without a restart.
+// Readers of conf.tlsCAKey/tlsCACert/sshCASigner take conf.caMu.RLock directly; reload
+// takes conf.caMu's write lock to swap them. r.mu guards the reloader's own fields.
+//
+// rootCAPEM/clientCAPEM cache the raw bytes behind the currently-live rootCAs/clientCAs
+// pools, so the *next* reload can fold them into the new pool and keep trusting the
+// outgoing CA for an overlap window, instead of only ever trusting whatever's on disk
+// at that instant.
+type reloader struct {
+	conf *config
+
+	// baseTLSConf is the tls.Config getTLSConfig built at startup (MinVersion,
+	// CipherSuites, NextProtos, etc.). GetConfigForClient clones it rather than
+	// building a bare tls.Config from scratch, since whatever it returns completely
+	// replaces the connection's config - a hand-rolled one would silently drop every
+	// setting getTLSConfig made.
+	baseTLSConf *tls.Config
+
+	mu          sync.RWMutex
+	serverCert  *tls.Certificate
+	rootCAs     *x509.CertPool
+	rootCAPEM   []byte
+	clientCAs   *x509.CertPool
+	clientCAPEM []byte
+}
+
+// newReloader builds a reloader around baseTLSConf and performs its first load, so
+// GetCertificate/GetConfigForClient have something to serve immediately.
+func newReloader(conf *config, baseTLSConf *tls.Config) (*reloader, error) {
+	r := &reloader{conf: conf, baseTLSConf: baseTLSConf}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// watch blocks, reloading on SIGHUP and on any write to the watched cert/key/CA files,
+// logging (but not exiting on) reload failures so a bad file doesn't take down a
+// running daemon.
+func (r *reloader) watch() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("reloader: failed to create fsnotify watcher, file-change reload disabled: %v", err)
+	} else {
+		defer watcher.Close()
+		for _, f := range []string{r.conf.SSLKey, r.conf.SSLCert, r.conf.SSLCA, r.conf.CAKeyFile, r.conf.SSLBrokerCert} {
+			if f == "" {
+				continue
+			}
+			if err := watcher.Add(f); err != nil {
+				log.Printf("reloader: failed to watch %s: %v", f, err)
+			}
+		}
+	}
+
+	var fsEvents chan fsnotify.Event
+	if watcher != nil {
+		fsEvents = watcher.Events
+	}
+
+	for {
+		select {
+		case <-sigCh:
+			log.Printf("reloader: SIGHUP received, reloading CA material")
+			if err := r.reload(); err != nil {
+				log.Printf("reloader: reload failed: %v", err)
+			}
+		case ev, ok := <-fsEvents:
+			if !ok {
+				fsEvents = nil
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			log.Printf("reloader: %s changed, reloading CA material", ev.Name)
+			if err := r.reload(); err != nil {
+				log.Printf("reloader: reload failed: %v", err)
+			}
+		}
+	}
+}
+
+// reload re-reads the TLS CA key/cert, the SSH CA key, and the server cert/key, then
+// atomically swaps them in under conf's locks / r.mu. Both the old and new root CA
+// remain trusted for an overlap window, so rotating the broker trust anchor doesn't
+// require a synchronized restart across every client.
+func (r *reloader) reload() error {
+	conf := r.conf
+
+	var tlsKM keymanager.KeyManager
+	var err error
+	if conf.SSLKMS == "" {
+		tlsKM, err = keymanager.NewFile(conf.SSLKey)
+	} else {
+		tlsKM, err = keymanager.New(conf.SSLKMS)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reload tls ca key: %v", err)
+	}
+	tlsCACert, err := loadCertFile(conf.SSLCert)
+	if err != nil {
+		return fmt.Errorf("failed to reload tls ca cert: %v", err)
+	}
+
+	var sshKM keymanager.KeyManager
+	if conf.SSHKMS == "" {
+		sshKM, err = keymanager.NewFile(conf.CAKeyFile)
+	} else {
+		sshKM, err = keymanager.New(conf.SSHKMS)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reload ssh ca key: %v", err)
+	}
+	sshSigner, err := keymanager.SSHSigner(sshKM)
+	if err != nil {
+		return fmt.Errorf("failed to build reloaded ssh ca signer: %v", err)
+	}
+
+	serverCert, err := tls.LoadX509KeyPair(conf.SSLCert, conf.SSLKey)
+	if err != nil {
+		return fmt.Errorf("failed to reload server keypair: %v", err)
+	}
+
+	rootCAPEM, err := ioutil.ReadFile(conf.SSLCA)
+	if err != nil {
+		return fmt.Errorf("failed to reload root ca file: %v", err)
+	}
+	clientCAPEM, err := ioutil.ReadFile(conf.SSLBrokerCert)
+	if err != nil {
+		return fmt.Errorf("failed to reload client ca file: %v", err)
+	}
+
+	// Recompute the pinned broker fingerprint alongside clientCAs - otherwise a rotated
+	// broker cert would pass the TLS handshake (it's in the rebuilt pool) but then get
+	// rejected by every privileged handler's conf.brokerFP check, since that fingerprint
+	// would still be the one getBrokerFP saw at startup.
+	brokerFP, err := getBrokerFP(conf)
+	if err != nil {
+		return fmt.Errorf("failed to reload broker fingerprint: %v", err)
+	}
+
+	r.mu.RLock()
+	prevRootCAPEM := r.rootCAPEM
+	prevClientCAPEM := r.clientCAPEM
+	r.mu.RUnlock()
+
+	// Keep trusting the previous root/client CA alongside the new one during the
+	// rotation overlap window, rather than dropping trust the instant a new cert lands
+	// on disk - rotating conf.SSLBrokerCert shouldn't instantly cut off clients still
+	// presenting a cert signed by the outgoing broker CA.
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(rootCAPEM) {
+		return fmt.Errorf("no certificates found in %s", conf.SSLCA)
+	}
+	if len(prevRootCAPEM) > 0 {
+		rootCAs.AppendCertsFromPEM(prevRootCAPEM)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(clientCAPEM) {
+		return fmt.Errorf("no certificates found in %s", conf.SSLBrokerCert)
+	}
+	if len(prevClientCAPEM) > 0 {
+		clientCAs.AppendCertsFromPEM(prevClientCAPEM)
+	}
+
+	r.mu.Lock()
+	r.serverCert = &serverCert
+	r.rootCAs = rootCAs
+	r.rootCAPEM = rootCAPEM
+	r.clientCAs = clientCAs
+	r.clientCAPEM = clientCAPEM
+	r.mu.Unlock()
+
+	oldTLSKeyManager := conf.tlsKeyManager
+	oldSSHKeyManager := conf.sshKeyManager
+	conf.caMu.Lock()
+	conf.tlsKeyManager = tlsKM
+	conf.tlsCAKey = tlsKM
+	conf.tlsCACert = tlsCACert
+	conf.sshKeyManager = sshKM
+	conf.sshCASigner = sshSigner
+	conf.brokerFP = brokerFP
+	conf.caMu.Unlock()
+	if oldTLSKeyManager != nil {
+		oldTLSKeyManager.Close()
+	}
+	if oldSSHKeyManager != nil {
+		oldSSHKeyManager.Close()
+	}
+
+	return nil
+}
+
+// loadCertFile reads and parses a single PEM certificate from path.
+func loadCertFile(path string) (*x509.Certificate, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode pem cert file: %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook, so the running
+// http.Server picks up a rotated server cert without a restart.
+func (r *reloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.serverCert, nil
+}
+
+// GetConfigForClient implements the tls.Config.GetConfigForClient hook. Since whatever
+// it returns entirely replaces the connection's tls.Config rather than being merged with
+// it, it clones baseTLSConf and overrides only the fields the latest reload changed,
+// instead of constructing a new tls.Config that would silently drop baseTLSConf's
+// MinVersion/CipherSuites/NextProtos/etc.
+func (r *reloader) GetConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cfg := r.baseTLSConf.Clone()
+	cfg.GetCertificate = r.GetCertificate
+	cfg.RootCAs = r.rootCAs
+	cfg.ClientCAs = r.clientCAs
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/boltdb/bolt"
+)
+
+// revocationEntry is the value stored in conf.bucketNameRevocations, keyed by the
+// big-endian bytes of the certificate serial number.
+type revocationEntry struct {
+	Reason      int       `json:"reason"`
+	RevokedAt   time.Time `json:"revoked_at"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+type revokeParams struct {
+	serial      string
+	fingerprint string
+	reason      int
+}
+
+// revokeCertHandler records a revocation for a previously issued TLS client certificate.
+// Like tlsCertHandler, it is only reachable by the cert broker.
+func revokeCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if len(r.TLS.PeerCertificates) == 0 || bytes.Compare(conf.brokerFP, tlsCertFP(r.TLS.PeerCertificates[0])) != 0 {
+		log.Printf("Not authorized to revoke certificates: ip[%s]", r.RemoteAddr)
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	p := revokeParams{
+		serial:      r.PostFormValue("serial"),
+		fingerprint: r.PostFormValue("fingerprint"),
+		reason:      int(ocsp.Unspecified),
+	}
+	if reasonForm := r.PostFormValue("reason"); reasonForm != "" {
+		reason, err := strconv.Atoi(reasonForm)
+		if err != nil {
+			http.Error(w, "reason is not a valid integer", http.StatusBadRequest)
+			return
+		}
+		p.reason = reason
+	}
+
+	if p.serial == "" {
+		http.Error(w, "serial missing from request", http.StatusBadRequest)
+		return
+	}
+	serial, ok := new(big.Int).SetString(p.serial, 16)
+	if !ok {
+		http.Error(w, "serial is not a valid hex number", http.StatusBadRequest)
+		return
+	}
+
+	if err := dbRecordRevocation(conf, serial, p.reason, p.fingerprint); err != nil {
+		log.Printf("Failed to record revocation: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Revoked certificate: serial[%s] reason[%d]", serial.Text(16), p.reason)
+	w.WriteHeader(http.StatusOK)
+}
+
+// dbRecordRevocation persists a revocation in the certrevocations bucket.
+func dbRecordRevocation(conf *config, serial *big.Int, reason int, fingerprint string) error {
+	entry := revocationEntry{
+		Reason:      reason,
+		RevokedAt:   time.Now(),
+		Fingerprint: fingerprint,
+	}
+	val, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal revocation entry: %v", err)
+	}
+
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(conf.bucketNameRevocations)
+		if err != nil {
+			return fmt.Errorf("failed to open certrevocations bucket: %v", err)
+		}
+		return b.Put(serial.Bytes(), val)
+	})
+}
+
+// dbIsRevoked reports whether serial has a recorded revocation.
+func dbIsRevoked(conf *config, serial *big.Int) (bool, revocationEntry, error) {
+	var entry revocationEntry
+	var found bool
+
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(conf.bucketNameRevocations)
+		if b == nil {
+			return nil
+		}
+		val := b.Get(serial.Bytes())
+		if val == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(val, &entry)
+	})
+
+	return found, entry, err
+}
+
+// dbRevokedSerials returns every revoked serial along with its revocation entry, for
+// use by the CRL/KRL generators.
+func dbRevokedSerials(conf *config) (map[string]revocationEntry, error) {
+	revoked := make(map[string]revocationEntry)
+
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(conf.bucketNameRevocations)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var entry revocationEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			revoked[new(big.Int).SetBytes(k).Text(16)] = entry
+			return nil
+		})
+	})
+
+	return revoked, err
+}
+
+// VerifyCertificate rejects re-issuance requests for identities whose certificate has
+// already been revoked. Cert handlers should call this before signing a CSR for a
+// principal that previously held a certificate.
+func VerifyCertificate(conf *config, serial *big.Int) error {
+	revoked, entry, err := dbIsRevoked(conf, serial)
+	if err != nil {
+		return fmt.Errorf("failed to check revocation status: %v", err)
+	}
+	if revoked {
+		return fmt.Errorf("certificate serial %s was revoked at %s (reason %d)", serial.Text(16), entry.RevokedAt, entry.Reason)
+	}
+	return nil
+}
+
+// dbRecordIdentitySerial remembers serial as the most recently issued TLS client
+// certificate for identity (the CSR's CommonName), so the next request for that
+// identity can be checked against VerifyCertificate before a new cert is signed.
+func dbRecordIdentitySerial(conf *config, identity string, serial *big.Int) error {
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(conf.bucketNameIdentitySerial)
+		if err != nil {
+			return fmt.Errorf("failed to open certidentityserial bucket: %v", err)
+		}
+		return b.Put([]byte(identity), serial.Bytes())
+	})
+}
+
+// dbLastIdentitySerial returns the most recently issued serial for identity, if any.
+func dbLastIdentitySerial(conf *config, identity string) (*big.Int, bool, error) {
+	var serial *big.Int
+	found := false
+
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(conf.bucketNameIdentitySerial)
+		if b == nil {
+			return nil
+		}
+		val := b.Get([]byte(identity))
+		if val == nil {
+			return nil
+		}
+		found = true
+		serial = new(big.Int).SetBytes(val)
+		return nil
+	})
+
+	return serial, found, err
+}
+
+// startCRLUpdater runs in the background, regenerating the signed CRL and KRL every
+// conf.crlInterval and caching them behind conf.crlMu for crlHandler/krlHandler to serve.
+func startCRLUpdater(conf *config) {
+	for {
+		if crl, err := generateCRL(conf); err != nil {
+			log.Printf("Failed to generate CRL: %v", err)
+		} else {
+			conf.crlMu.Lock()
+			conf.cachedCRL = crl
+			conf.crlMu.Unlock()
+		}
+
+		if krl, err := generateKRL(conf); err != nil {
+			log.Printf("Failed to generate KRL: %v", err)
+		} else {
+			conf.crlMu.Lock()
+			conf.cachedKRL = krl
+			conf.crlMu.Unlock()
+		}
+
+		time.Sleep(conf.crlInterval)
+	}
+}
+
+// generateCRL builds and signs a new X.509 CRL from the current revocation bucket.
+func generateCRL(conf *config) ([]byte, error) {
+	revoked, err := dbRevokedSerials(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revoked serials: %v", err)
+	}
+
+	now := time.Now()
+	revokedCerts := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for hexSerial, entry := range revoked {
+		serial, ok := new(big.Int).SetString(hexSerial, 16)
+		if !ok {
+			continue
+		}
+		revokedCerts = append(revokedCerts, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: entry.RevokedAt,
+		})
+	}
+
+	conf.caMu.RLock()
+	tlsCACert := conf.tlsCACert
+	tlsCAKey := conf.tlsCAKey
+	conf.caMu.RUnlock()
+
+	crl, err := tlsCACert.CreateCRL(rand.Reader, tlsCAKey, revokedCerts, now, now.Add(conf.crlInterval))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create crl: %v", err)
+	}
+
+	return crl, nil
+}
+
+// crlHandler serves the most recently generated CRL.
+func crlHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	conf.crlMu.RLock()
+	crl := conf.cachedCRL
+	conf.crlMu.RUnlock()
+
+	if crl == nil {
+		http.Error(w, "CRL not yet generated", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// ocspHandler implements a minimal RFC 6960 responder backed by the revocation bucket.
+func ocspHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	req, err := ocsp.ParseRequest(body)
+	if err != nil {
+		log.Printf("Failed to parse OCSP request: %v", err)
+		http.Error(w, "Invalid OCSP request", http.StatusBadRequest)
+		return
+	}
+
+	status := ocsp.Good
+	revokedAt := time.Time{}
+	revoked, entry, err := dbIsRevoked(conf, req.SerialNumber)
+	if err != nil {
+		log.Printf("Failed to check revocation status: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		status = ocsp.Revoked
+		revokedAt = entry.RevokedAt
+	}
+
+	conf.caMu.RLock()
+	tlsCACert := conf.tlsCACert
+	tlsCAKey := conf.tlsCAKey
+	conf.caMu.RUnlock()
+
+	now := time.Now()
+	resp, err := ocsp.CreateResponse(tlsCACert, tlsCACert, ocsp.Response{
+		Status:       status,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(conf.crlInterval),
+		RevokedAt:    revokedAt,
+	}, tlsCAKey)
+	if err != nil {
+		log.Printf("Failed to sign OCSP response: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// krlHandler serves the most recently generated SSH KRL.
+func krlHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	conf.crlMu.RLock()
+	krl := conf.cachedKRL
+	conf.crlMu.RUnlock()
+
+	if krl == nil {
+		http.Error(w, "KRL not yet generated", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(krl)
+}
+
+// krlMagic is the 8 byte "SSHKRL\n\0" file magic ssh-keygen -k writes at the start of a
+// binary format 1 Key Revocation List.
+var krlMagic = []byte("SSHKRL\n\x00")
+
+// krlSectionCertificates is the KRL_SECTION_CERTIFICATES section type. Every section (and,
+// within it, every cert-spec sub-section) is framed as a single type byte followed by a
+// big-endian uint32 length and that many bytes of type-specific data; an unrecognized type
+// byte makes the whole file fail to parse, so this must match exactly what ssh-keygen/sshd
+// expect.
+const krlSectionCertificates = 1
+
+// krlCertSpecSerialList is the KRL_SECT_CERT_SERIAL_LIST cert-spec sub-section type: its
+// data is a sorted list of revoked certificate serials, each a fixed 8 byte big-endian
+// uint64, scoped to the ca_key named earlier in the enclosing KRL_SECTION_CERTIFICATES.
+const krlCertSpecSerialList = 0x20
+
+// generateKRL builds a binary format SSH KRL (see PROTOCOL.krl) revoking every serial in
+// the revocation bucket under the SSH CA's public key. Trust in the file comes from how
+// it's served (the /krl endpoint, same as sshd's RevokedKeys directive trusts whatever
+// file it's pointed at) rather than an embedded signature: a KRL_SECTION_SIGNATURE was
+// tried here previously, but every byte layout tried against a real ssh-keygen -Q -f <ca>
+// -l round-trip made the whole file fail to parse, so it's omitted rather than shipping a
+// KRL real clients reject.
+func generateKRL(conf *config) ([]byte, error) {
+	revoked, err := dbRevokedSerials(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revoked serials: %v", err)
+	}
+
+	var serials []uint64
+	for hexSerial := range revoked {
+		serial, ok := new(big.Int).SetString(hexSerial, 16)
+		if !ok || !serial.IsUint64() {
+			continue
+		}
+		serials = append(serials, serial.Uint64())
+	}
+	sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+
+	conf.caMu.RLock()
+	signer := conf.sshCASigner
+	conf.caMu.RUnlock()
+
+	var buf bytes.Buffer
+	buf.Write(krlMagic)
+	writeUint32(&buf, 1)                         // krl_format_version
+	writeUint64(&buf, uint64(time.Now().Unix())) // krl_version
+	writeUint64(&buf, uint64(time.Now().Unix())) // generated_date
+	writeUint64(&buf, 0)                         // flags
+	writeString(&buf, "")                        // reserved
+	writeString(&buf, "curse")                   // comment
+
+	var certSection bytes.Buffer
+	writeBytes(&certSection, signer.PublicKey().Marshal()) // ca_key
+	writeUint32(&certSection, 0)                            // reserved
+
+	var serialList bytes.Buffer
+	for _, serial := range serials {
+		writeUint64(&serialList, serial)
+	}
+	writeTypedSection(&certSection, krlCertSpecSerialList, serialList.Bytes())
+
+	writeTypedSection(&buf, krlSectionCertificates, certSection.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeUint64(buf *bytes.Buffer, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUint32(buf, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUint32(buf, uint32(len(b)))
+	buf.Write(b)
+}
+
+func writeSection(buf *bytes.Buffer, section []byte) {
+	writeUint32(buf, uint32(len(section)))
+	buf.Write(section)
+}
+
+// writeTypedSection writes a KRL section or cert-spec sub-section: a type byte followed
+// by a length-prefixed body, per PROTOCOL.krl's framing.
+func writeTypedSection(buf *bytes.Buffer, sectionType byte, data []byte) {
+	buf.WriteByte(sectionType)
+	writeSection(buf, data)
+}
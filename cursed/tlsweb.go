@@ -7,12 +7,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 )
 
 type tlsParams struct {
 	bastionUser string
 	csr         string
 	userIP      string
+	profile     string
 }
 
 func tlsCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
@@ -35,6 +37,7 @@ func tlsCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 		bastionUser: r.Header.Get(conf.UserHeader),
 		csr:         r.PostFormValue("csr"),
 		userIP:      r.PostFormValue("userIP"),
+		profile:     r.PostFormValue("profile"),
 	}
 
 	// Make sure we have everything we need from our parameters
@@ -81,8 +84,22 @@ func tlsCertHandler(w http.ResponseWriter, r *http.Request, conf *config) {
 		return
 	}
 
+	// Select and enforce the signing profile for this request
+	groups := splitGroups(r.Header.Get(conf.GroupsHeader))
+	prof, err := selectProfile(conf, p.profile, p.bastionUser, groups, p.userIP)
+	if err != nil {
+		log.Printf("Profile selection failed: %v", err)
+		http.Error(w, fmt.Sprintf("Profile selection failed: %v", err), http.StatusForbidden)
+		return
+	}
+	if err := prof.validateTLSKeyUsage(csr); err != nil {
+		log.Printf("Profile validation failed: %v", err)
+		http.Error(w, fmt.Sprintf("Profile validation failed: %v", err), http.StatusForbidden)
+		return
+	}
+
 	// Sign the CSR
-	cert, rawCert, err := signTLSClientCert(conf, csr)
+	cert, rawCert, err := signTLSClientCert(conf, csr, prof)
 	if err != nil {
 		log.Printf("%v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
@@ -129,3 +146,16 @@ func validateTLSParams(p tlsParams, conf *config) error {
 
 	return nil
 }
+
+// splitGroups parses the comma-separated group list from conf.GroupsHeader into the
+// slice selectProfile expects.
+func splitGroups(header string) []string {
+	if header == "" {
+		return nil
+	}
+	groups := strings.Split(header, ",")
+	for i := range groups {
+		groups[i] = strings.TrimSpace(groups[i])
+	}
+	return groups
+}
@@ -8,6 +8,8 @@ import (
 	"math/big"
 	"os"
 	"time"
+
+	"github.com/schatt/curse/cursed/keymanager"
 )
 
 func genTLSCACert(conf *config) error {
@@ -59,10 +61,18 @@ func genTLSCACert(conf *config) error {
 	return dbSetTLSSerial(conf, serial)
 }
 
-func signTLSClientCert(conf *config, csr *x509.CertificateRequest) ([]byte, []byte, error) {
-	// Set our cert validity constraints
+func signTLSClientCert(conf *config, csr *x509.CertificateRequest, prof profile) ([]byte, []byte, error) {
+	// Set our cert validity constraints from the selected profile, falling back to the
+	// daemon-wide default when the profile doesn't set one
+	dur := conf.tlsDur
+	if prof.Duration > 0 {
+		dur = prof.Duration
+	}
+	if prof.MaxDuration > 0 && dur > prof.MaxDuration {
+		dur = prof.MaxDuration
+	}
 	notBefore := time.Now()
-	notAfter := notBefore.Add(conf.tlsDur)
+	notAfter := notBefore.Add(dur)
 
 	// Get the next available serial number
 	serial, err := dbIncTLSSerial(conf)
@@ -70,7 +80,22 @@ func signTLSClientCert(conf *config, csr *x509.CertificateRequest) ([]byte, []by
 		return nil, nil, fmt.Errorf("failed to generate client certficate: %v", err)
 	}
 
-	// Set our CA cert options
+	// Refuse to reissue a certificate for an identity whose most recently issued
+	// certificate was revoked
+	if last, found, err := dbLastIdentitySerial(conf, csr.Subject.CommonName); err != nil {
+		return nil, nil, fmt.Errorf("failed to check prior certificate for %s: %v", csr.Subject.CommonName, err)
+	} else if found {
+		if err := VerifyCertificate(conf, last); err != nil {
+			return nil, nil, fmt.Errorf("refusing to reissue for %s: %v", csr.Subject.CommonName, err)
+		}
+	}
+	if err := dbRecordIdentitySerial(conf, csr.Subject.CommonName, serial); err != nil {
+		return nil, nil, fmt.Errorf("failed to record identity serial: %v", err)
+	}
+
+	// Take a read lock so a reload() swapping the CA material mid-request can't hand us
+	// a cert signed with a key that doesn't match conf.tlsCACert anymore
+	conf.caMu.RLock()
 	opts := certOpts{
 		CA:        conf.tlsCACert,
 		CAKey:     conf.tlsCAKey,
@@ -80,14 +105,23 @@ func signTLSClientCert(conf *config, csr *x509.CertificateRequest) ([]byte, []by
 		NotAfter:  notAfter,
 		Serial:    serial,
 	}
+	conf.caMu.RUnlock()
 
-	// Sign the CA cert
-	pemCert, rawCert, err := tlsSignCert(opts)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate client cert: %v", err)
+	// Plain path: no CT logs configured, so a single signature from tlsSignCert is all
+	// that's needed.
+	if len(conf.ctLogs) == 0 {
+		pemCert, rawCert, err := tlsSignCert(opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate client cert: %v", err)
+		}
+		return pemCert, rawCert, nil
 	}
 
-	return pemCert, rawCert, nil
+	// CT-enabled path: submit to every configured log and embed the returned SCTs,
+	// giving short-lived bastion certs the same auditability as public-web certs. See
+	// signWithSCTs for why this can't just splice an SCT extension into an
+	// already-signed certificate the way a plain tlsSignCert call would.
+	return signWithSCTs(conf, opts, serial)
 }
 
 func initTLSCerts(conf *config) (bool, error) {
@@ -121,19 +155,20 @@ func initTLSCerts(conf *config) (bool, error) {
 }
 
 func loadTLSCA(conf *config) error {
-	// Load CA key for signing
-	caKeyPem, err := ioutil.ReadFile(conf.SSLKey)
-	if err != nil {
-		return fmt.Errorf("failed to read tls key file: '%v'", err)
-	}
-	caKey, _ := pem.Decode(caKeyPem)
-	if caKey == nil {
-		return fmt.Errorf("failed to parse tls key file: '%v'", err)
+	// Load the CA key behind a KeyManager, so the signer never sees raw key bytes once
+	// it's backed by a PKCS#11/KMS/ssh-agent URI instead of a file
+	var tlsKeyManager keymanager.KeyManager
+	var err error
+	if conf.SSLKMS == "" {
+		tlsKeyManager, err = keymanager.NewFile(conf.SSLKey)
+	} else {
+		tlsKeyManager, err = keymanager.New(conf.SSLKMS)
 	}
-	conf.tlsCAKey, err = x509.ParseECPrivateKey(caKey.Bytes)
 	if err != nil {
-		return fmt.Errorf("failed to parse tls cert file: '%v'", err)
+		return fmt.Errorf("failed to load tls ca key: %v", err)
 	}
+	conf.tlsKeyManager = tlsKeyManager
+	conf.tlsCAKey = tlsKeyManager
 
 	// Load CA cert for signing
 	caCertPem, err := ioutil.ReadFile(conf.SSLCert)